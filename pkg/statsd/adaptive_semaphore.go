@@ -0,0 +1,81 @@
+package statsd
+
+import (
+	"context"
+	"sync"
+)
+
+// adaptiveSemaphore bounds concurrency with an AIMD controller on top of a channel-based semaphore: on success the
+// limit grows by one slot (up to max), on failure it halves (down to min). This lets a slow or failing downstream
+// shed concurrent load automatically instead of pinning maxRequests goroutines against it while the consolidator
+// channel backs up behind them.
+type adaptiveSemaphore struct {
+	sem chan struct{}
+	min int
+	max int
+
+	mu          sync.Mutex
+	limit       int
+	outstanding int // number of tokens currently issued (in the channel or held by a caller)
+}
+
+func newAdaptiveSemaphore(initial, min, max int) *adaptiveSemaphore {
+	a := &adaptiveSemaphore{
+		sem:         make(chan struct{}, max),
+		min:         min,
+		max:         max,
+		limit:       initial,
+		outstanding: initial,
+	}
+	for i := 0; i < initial; i++ {
+		a.sem <- struct{}{}
+	}
+	return a
+}
+
+// Acquire blocks until a slot is available or ctx is done, returning false in the latter case.
+func (a *adaptiveSemaphore) Acquire(ctx context.Context) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-a.sem:
+		return true
+	}
+}
+
+// Release returns the slot acquired by a matching Acquire, adjusting the limit based on whether that request
+// succeeded: grows by one on success, halves (floored at min) on failure.
+func (a *adaptiveSemaphore) Release(success bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if success {
+		if a.limit < a.max {
+			a.limit++
+		}
+	} else {
+		a.limit /= 2
+		if a.limit < a.min {
+			a.limit = a.min
+		}
+	}
+
+	if a.outstanding <= a.limit {
+		// capacity grew, or stayed the same: hand the slot straight back (and mint a new one if we grew)
+		if a.outstanding < a.limit {
+			a.outstanding++
+			a.sem <- struct{}{}
+		}
+		a.sem <- struct{}{}
+	} else {
+		// capacity shrank below what's currently issued: retire this slot instead of returning it
+		a.outstanding--
+	}
+}
+
+// Limit returns the current AIMD-controlled concurrency limit, for metrics reporting.
+func (a *adaptiveSemaphore) Limit() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.limit
+}
@@ -0,0 +1,148 @@
+package statsd
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// circuitBreakerState is the externally visible state of a circuitBreaker.
+type circuitBreakerState int32
+
+const (
+	breakerClosed circuitBreakerState = iota
+	breakerOpen
+	breakerHalfOpen
+)
+
+func (s circuitBreakerState) String() string {
+	switch s {
+	case breakerOpen:
+		return "open"
+	case breakerHalfOpen:
+		return "half-open"
+	default:
+		return "closed"
+	}
+}
+
+type bucketCounts struct {
+	successes uint64
+	failures  uint64
+}
+
+// circuitBreaker trips when the failure ratio over a sliding window of buckets exceeds failureRatio, fast-failing
+// callers for cooldown afterwards. Once cooldown elapses it lets exactly one caller through as a half-open probe;
+// that probe closes the breaker on success or re-trips it (and restarts cooldown) on failure.
+type circuitBreaker struct {
+	bucketWidth  time.Duration
+	failureRatio float64
+	minSamples   uint64
+	cooldown     time.Duration
+
+	mu          sync.Mutex
+	buckets     []bucketCounts // buckets[0] is the current bucket
+	bucketStart time.Time
+	state       int32 // circuitBreakerState, read/written via atomic so State() doesn't need the lock
+	openedAt    time.Time
+}
+
+func newCircuitBreaker(bucketWidth time.Duration, numBuckets int, failureRatio float64, minSamples uint64, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{
+		bucketWidth:  bucketWidth,
+		failureRatio: failureRatio,
+		minSamples:   minSamples,
+		cooldown:     cooldown,
+		buckets:      make([]bucketCounts, numBuckets),
+		bucketStart:  time.Now(),
+	}
+}
+
+// Allow reports whether a caller should proceed. Every call to Allow that returns true must be followed by exactly
+// one call to Record with the outcome.
+func (cb *circuitBreaker) Allow() bool {
+	if circuitBreakerState(atomic.LoadInt32(&cb.state)) == breakerClosed {
+		return true
+	}
+
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	switch circuitBreakerState(cb.state) {
+	case breakerClosed:
+		return true
+	case breakerHalfOpen:
+		return false // a probe is already in flight
+	default: // breakerOpen
+		if time.Since(cb.openedAt) < cb.cooldown {
+			return false
+		}
+		atomic.StoreInt32(&cb.state, int32(breakerHalfOpen))
+		return true
+	}
+}
+
+// Record reports the outcome of a call previously allowed by Allow.
+func (cb *circuitBreaker) Record(success bool) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	cb.rotate()
+	if success {
+		cb.buckets[0].successes++
+	} else {
+		cb.buckets[0].failures++
+	}
+
+	switch circuitBreakerState(cb.state) {
+	case breakerHalfOpen:
+		if success {
+			atomic.StoreInt32(&cb.state, int32(breakerClosed))
+			for i := range cb.buckets {
+				cb.buckets[i] = bucketCounts{}
+			}
+		} else {
+			cb.trip()
+		}
+	case breakerClosed:
+		var successes, failures uint64
+		for _, b := range cb.buckets {
+			successes += b.successes
+			failures += b.failures
+		}
+		if total := successes + failures; total >= cb.minSamples && float64(failures)/float64(total) > cb.failureRatio {
+			cb.trip()
+		}
+	}
+}
+
+// trip must be called with cb.mu held.
+func (cb *circuitBreaker) trip() {
+	atomic.StoreInt32(&cb.state, int32(breakerOpen))
+	cb.openedAt = time.Now()
+}
+
+// rotate must be called with cb.mu held; it advances the bucket ring so buckets[0] always covers "now".
+func (cb *circuitBreaker) rotate() {
+	shift := int(time.Since(cb.bucketStart) / cb.bucketWidth)
+	if shift <= 0 {
+		return
+	}
+	if shift >= len(cb.buckets) {
+		shift = len(cb.buckets)
+		for i := range cb.buckets {
+			cb.buckets[i] = bucketCounts{}
+		}
+	} else {
+		copy(cb.buckets[shift:], cb.buckets[:len(cb.buckets)-shift])
+		for i := 0; i < shift; i++ {
+			cb.buckets[i] = bucketCounts{}
+		}
+	}
+	cb.bucketStart = cb.bucketStart.Add(time.Duration(shift) * cb.bucketWidth)
+}
+
+// State returns the breaker's current state for metrics reporting.
+func (cb *circuitBreaker) State() circuitBreakerState {
+	return circuitBreakerState(atomic.LoadInt32(&cb.state))
+}
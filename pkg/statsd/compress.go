@@ -0,0 +1,106 @@
+package statsd
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	compressionIdentity = "identity"
+	compressionDeflate  = "deflate"
+	compressionGzip     = "gzip"
+	compressionSnappy   = "snappy"
+	compressionZstd     = "zstd"
+)
+
+// Compressor encodes a payload for the wire, returning the encoded bytes and the Content-Encoding header value to
+// advertise alongside it.
+type Compressor interface {
+	Encode(raw []byte) (encoded []byte, contentEncoding string, err error)
+}
+
+// newCompressor builds the Compressor named by the http-transport.compression config key.
+func newCompressor(name string) (Compressor, error) {
+	switch name {
+	case compressionIdentity:
+		return identityCompressor{}, nil
+	case compressionDeflate:
+		return deflateCompressor{}, nil
+	case compressionGzip:
+		return gzipCompressor{}, nil
+	case compressionSnappy:
+		return snappyCompressor{}, nil
+	case compressionZstd:
+		return newZstdCompressor()
+	default:
+		return nil, fmt.Errorf("unknown compression %q, must be one of %s/%s/%s/%s/%s",
+			name, compressionIdentity, compressionDeflate, compressionGzip, compressionSnappy, compressionZstd)
+	}
+}
+
+type identityCompressor struct{}
+
+func (identityCompressor) Encode(raw []byte) ([]byte, string, error) {
+	return raw, compressionIdentity, nil
+}
+
+// deflateCompressor is the original zlib-based encoding HttpForwarderHandlerV2 has always used.
+type deflateCompressor struct{}
+
+func (deflateCompressor) Encode(raw []byte) ([]byte, string, error) {
+	buf := &bytes.Buffer{}
+	w, err := zlib.NewWriterLevel(buf, zlib.BestCompression)
+	if err != nil {
+		return nil, "", err
+	}
+	if _, err := w.Write(raw); err != nil {
+		return nil, "", err
+	}
+	if err := w.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), compressionDeflate, nil
+}
+
+type gzipCompressor struct{}
+
+func (gzipCompressor) Encode(raw []byte) ([]byte, string, error) {
+	buf := &bytes.Buffer{}
+	w := gzip.NewWriter(buf)
+	if _, err := w.Write(raw); err != nil {
+		return nil, "", err
+	}
+	if err := w.Close(); err != nil {
+		return nil, "", err
+	}
+	return buf.Bytes(), compressionGzip, nil
+}
+
+type snappyCompressor struct{}
+
+func (snappyCompressor) Encode(raw []byte) ([]byte, string, error) {
+	return snappy.Encode(nil, raw), compressionSnappy, nil
+}
+
+// zstdCompressor wraps a single long-lived *zstd.Encoder; zstd.NewWriter spins up encoder goroutines, so it's built
+// once per HttpForwarderHandlerV2 rather than per-request.
+type zstdCompressor struct {
+	encoder *zstd.Encoder
+}
+
+func newZstdCompressor() (*zstdCompressor, error) {
+	encoder, err := zstd.NewWriter(nil)
+	if err != nil {
+		return nil, err
+	}
+	return &zstdCompressor{encoder: encoder}, nil
+}
+
+func (z *zstdCompressor) Encode(raw []byte) ([]byte, string, error) {
+	return z.encoder.EncodeAll(raw, nil), compressionZstd, nil
+}
@@ -0,0 +1,41 @@
+package statsd
+
+import (
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pb"
+)
+
+// buildEventV2 converts a gostatsd.Event into the pb.EventV2 wire representation shared by the http, gRPC and
+// Kafka forwarder handlers.
+func buildEventV2(e *gostatsd.Event) *pb.EventV2 {
+	message := &pb.EventV2{
+		Title:          e.Title,
+		Text:           e.Text,
+		DateHappened:   e.DateHappened,
+		Hostname:       e.Hostname,
+		AggregationKey: e.AggregationKey,
+		SourceTypeName: e.SourceTypeName,
+		Tags:           e.Tags,
+		SourceIP:       string(e.SourceIP),
+	}
+
+	switch e.Priority {
+	case gostatsd.PriNormal:
+		message.Priority = pb.EventV2_Normal
+	case gostatsd.PriLow:
+		message.Priority = pb.EventV2_Low
+	}
+
+	switch e.AlertType {
+	case gostatsd.AlertInfo:
+		message.Type = pb.EventV2_Info
+	case gostatsd.AlertWarning:
+		message.Type = pb.EventV2_Warning
+	case gostatsd.AlertError:
+		message.Type = pb.EventV2_Error
+	case gostatsd.AlertSuccess:
+		message.Type = pb.EventV2_Success
+	}
+
+	return message
+}
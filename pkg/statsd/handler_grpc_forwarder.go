@@ -0,0 +1,287 @@
+package statsd
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pb"
+	"github.com/atlassian/gostatsd/pkg/stats"
+
+	"github.com/ash2k/stager/wait"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/keepalive"
+)
+
+const (
+	defaultGrpcConsolidatorFlushInterval = 1 * time.Second
+	defaultGrpcApiEndpoint               = ""
+	defaultGrpcKeepaliveTime             = 30 * time.Second
+	defaultGrpcKeepaliveTimeout          = 10 * time.Second
+	defaultGrpcTLS                       = true
+	defaultGrpcServiceConfig             = `{
+		"methodConfig": [{
+			"name": [{"service": "pb.Forwarder"}],
+			"retryPolicy": {
+				"maxAttempts": 5,
+				"initialBackoff": "0.1s",
+				"maxBackoff": "10s",
+				"backoffMultiplier": 2.0,
+				"retryableStatusCodes": ["UNAVAILABLE"]
+			}
+		}]
+	}`
+)
+
+// GrpcForwarderHandler is a PipelineHandler which streams metrics to another gostatsd instance over gRPC.
+type GrpcForwarderHandler struct {
+	messagesCreated uint64 // atomic - messages which were created
+	messagesSent    uint64 // atomic - messages successfully sent
+	messagesDropped uint64 // atomic - messages dropped because the stream was down
+
+	logger              logrus.FieldLogger
+	conn                *grpc.ClientConn
+	client              pb.ForwarderClient
+	consolidator        *gostatsd.MetricConsolidator
+	consolidatedMetrics <-chan []*gostatsd.MetricMap
+	eventWg             sync.WaitGroup
+}
+
+// NewGrpcForwarderHandlerFromViper returns a new gRPC forwarder handler.
+func NewGrpcForwarderHandlerFromViper(logger logrus.FieldLogger, v *viper.Viper) (*GrpcForwarderHandler, error) {
+	subViper := getSubViper(v, "grpc-transport")
+	subViper.SetDefault("api-endpoint", defaultGrpcApiEndpoint)
+	subViper.SetDefault("consolidator-slots", v.GetInt(ParamMaxParsers))
+	subViper.SetDefault("flush-interval", defaultGrpcConsolidatorFlushInterval)
+	subViper.SetDefault("keepalive-time", defaultGrpcKeepaliveTime)
+	subViper.SetDefault("keepalive-timeout", defaultGrpcKeepaliveTimeout)
+	subViper.SetDefault("tls", defaultGrpcTLS)
+
+	return NewGrpcForwarderHandler(
+		logger,
+		subViper.GetString("api-endpoint"),
+		subViper.GetInt("consolidator-slots"),
+		subViper.GetDuration("flush-interval"),
+		subViper.GetDuration("keepalive-time"),
+		subViper.GetDuration("keepalive-timeout"),
+		subViper.GetBool("tls"),
+	)
+}
+
+// NewGrpcForwarderHandler returns a new handler which dispatches metrics over a persistent gRPC stream to another
+// gostatsd server.
+func NewGrpcForwarderHandler(logger logrus.FieldLogger, apiEndpoint string, consolidatorSlots int, flushInterval, keepaliveTime, keepaliveTimeout time.Duration, useTLS bool) (*GrpcForwarderHandler, error) {
+	if apiEndpoint == "" {
+		return nil, fmt.Errorf("api-endpoint is required")
+	}
+	if consolidatorSlots <= 0 {
+		return nil, fmt.Errorf("consolidator-slots must be positive")
+	}
+	if flushInterval <= 0 {
+		return nil, fmt.Errorf("flush-interval must be positive")
+	}
+
+	logger.WithFields(logrus.Fields{
+		"api-endpoint":       apiEndpoint,
+		"consolidator-slots": consolidatorSlots,
+		"flush-interval":     flushInterval,
+		"keepalive-time":     keepaliveTime,
+		"keepalive-timeout":  keepaliveTimeout,
+		"tls":                useTLS,
+	}).Info("created GrpcForwarderHandler")
+
+	var creds credentials.TransportCredentials
+	if useTLS {
+		creds = credentials.NewTLS(nil)
+	} else {
+		creds = insecure.NewCredentials()
+	}
+
+	conn, err := grpc.Dial(
+		apiEndpoint,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                keepaliveTime,
+			Timeout:             keepaliveTimeout,
+			PermitWithoutStream: true,
+		}),
+		grpc.WithDefaultServiceConfig(defaultGrpcServiceConfig),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial %s: %v", apiEndpoint, err)
+	}
+
+	ch := make(chan []*gostatsd.MetricMap)
+
+	return &GrpcForwarderHandler{
+		logger:              logger.WithField("component", "grpc-forwarder-handler"),
+		conn:                conn,
+		client:              pb.NewForwarderClient(conn),
+		consolidator:        gostatsd.NewMetricConsolidator(consolidatorSlots, flushInterval, ch),
+		consolidatedMetrics: ch,
+	}, nil
+}
+
+func (gfh *GrpcForwarderHandler) EstimatedTags() int {
+	return 0
+}
+
+func (gfh *GrpcForwarderHandler) DispatchMetrics(ctx context.Context, metrics []*gostatsd.Metric) {
+	gfh.consolidator.ReceiveMetrics(metrics)
+}
+
+// DispatchMetricMap hands a metric map straight to the consolidator, as DispatchMetrics does for metrics
+func (gfh *GrpcForwarderHandler) DispatchMetricMap(ctx context.Context, mm *gostatsd.MetricMap) {
+	gfh.consolidator.ReceiveMetricMap(mm)
+}
+
+func (gfh *GrpcForwarderHandler) RunMetrics(ctx context.Context) {
+	statser := stats.FromContext(ctx)
+
+	notify, cancel := statser.RegisterFlush()
+	defer cancel()
+
+	for {
+		select {
+		case <-notify:
+			gfh.emitMetrics(statser)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (gfh *GrpcForwarderHandler) emitMetrics(statser stats.Statser) {
+	messagesCreated := atomic.SwapUint64(&gfh.messagesCreated, 0)
+	messagesSent := atomic.SwapUint64(&gfh.messagesSent, 0)
+	messagesDropped := atomic.SwapUint64(&gfh.messagesDropped, 0)
+
+	statser.Count("grpc.forwarder.created", float64(messagesCreated), nil)
+	statser.Count("grpc.forwarder.sent", float64(messagesSent), nil)
+	statser.Count("grpc.forwarder.dropped", float64(messagesDropped), nil)
+	statser.Gauge("grpc.forwarder.conn_state", stateGauge(gfh.conn.GetState()), nil)
+}
+
+func stateGauge(s connectivity.State) float64 {
+	if s == connectivity.Ready {
+		return 1
+	}
+	return 0
+}
+
+func (gfh *GrpcForwarderHandler) Run(ctx context.Context) {
+	var wg wait.Group
+	defer wg.Wait()
+	defer gfh.conn.Close()
+	wg.StartWithContext(ctx, gfh.consolidator.Run)
+
+	if err := gfh.checkHealth(ctx); err != nil {
+		gfh.logger.WithError(err).Warn("forwarder endpoint health check failed, continuing anyway")
+	}
+
+	for {
+		stream, err := gfh.client.SendMetrics(ctx)
+		if err != nil {
+			gfh.logger.WithError(err).Warn("failed to open metrics stream, retrying")
+			if !sleepOrDone(ctx, time.Second) {
+				return
+			}
+			continue
+		}
+		if !gfh.runStream(ctx, stream) {
+			return
+		}
+	}
+}
+
+// runStream pumps consolidated metric maps into an open stream until it breaks or the context is done.
+// It returns false if the caller should stop entirely (context done), true if it should reconnect.
+//
+// Unlike the http and kafka forwarders, a failed Send/Recv drops the in-flight batch immediately instead of
+// backing off and retrying it: defaultGrpcServiceConfig already gives transient UNAVAILABLE errors a few retries
+// at the gRPC layer before they ever surface here, and once a stream-level error does surface it means the
+// stream itself is broken, so there's nothing left to retry it on. Reconnecting and letting the next flush
+// produce a fresh batch is simpler than buffering a batch across a stream teardown/rebuild.
+func (gfh *GrpcForwarderHandler) runStream(ctx context.Context, stream pb.Forwarder_SendMetricsClient) bool {
+	for {
+		select {
+		case <-ctx.Done():
+			return false
+		case metricMaps := <-gfh.consolidatedMetrics:
+			metricMap := mergeMaps(metricMaps)
+			message := translateToProtobufV2(metricMap)
+			atomic.AddUint64(&gfh.messagesCreated, 1)
+			if err := stream.Send(message); err != nil {
+				gfh.logger.WithError(err).Warn("failed to send metrics, reconnecting")
+				atomic.AddUint64(&gfh.messagesDropped, 1)
+				return true
+			}
+			if _, err := stream.Recv(); err != nil {
+				gfh.logger.WithError(err).Warn("failed to receive ack, reconnecting")
+				atomic.AddUint64(&gfh.messagesDropped, 1)
+				return true
+			}
+			atomic.AddUint64(&gfh.messagesSent, 1)
+		}
+	}
+}
+
+func sleepOrDone(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+///////// Event processing
+
+// Events are handled individually, because the context matters. If they're buffered through the consolidator, they'll
+// be processed on a goroutine with a context which will be closed during shutdown.  Events should be rare enough that
+// this isn't an issue.
+
+func (gfh *GrpcForwarderHandler) DispatchEvent(ctx context.Context, e *gostatsd.Event) {
+	gfh.eventWg.Add(1)
+	go gfh.dispatchEvent(ctx, e)
+}
+
+func (gfh *GrpcForwarderHandler) dispatchEvent(ctx context.Context, e *gostatsd.Event) {
+	defer gfh.eventWg.Done()
+
+	message := buildEventV2(e)
+
+	if _, err := gfh.client.SendEvent(ctx, message); err != nil {
+		gfh.logger.WithError(err).Info("failed to send event")
+	}
+}
+
+func (gfh *GrpcForwarderHandler) WaitForEvents() {
+	gfh.eventWg.Wait()
+}
+
+// checkHealth uses the standard grpc.health.v1 service to confirm the peer is ready to accept metrics before the
+// first stream is opened, so a misconfigured endpoint shows up as a clear log line at startup. Run only logs a
+// failed check; it still opens the stream and sends the first flush.
+func (gfh *GrpcForwarderHandler) checkHealth(ctx context.Context) error {
+	healthClient := grpc_health_v1.NewHealthClient(gfh.conn)
+	resp, err := healthClient.Check(ctx, &grpc_health_v1.HealthCheckRequest{Service: "pb.Forwarder"})
+	if err != nil {
+		return err
+	}
+	if resp.Status != grpc_health_v1.HealthCheckResponse_SERVING {
+		return fmt.Errorf("forwarder endpoint reports status %s", resp.Status)
+	}
+	return nil
+}
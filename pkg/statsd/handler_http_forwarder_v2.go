@@ -2,7 +2,6 @@ package statsd
 
 import (
 	"bytes"
-	"compress/zlib"
 	"context"
 	"crypto/tls"
 	"fmt"
@@ -21,40 +20,66 @@ import (
 	"github.com/ash2k/stager/wait"
 	"github.com/cenkalti/backoff"
 	"github.com/golang/protobuf/proto"
+	"github.com/golang/snappy"
+	"github.com/prometheus/prometheus/prompb"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/viper"
 	"github.com/tilinna/clock"
+	"golang.org/x/net/http2"
 )
 
 const (
-	defaultConsolidatorFlushInterval = 1 * time.Second
-	defaultClientTimeout             = 10 * time.Second
-	defaultCompress                  = true
-	defaultEnableHttp2               = false
-	defaultApiEndpoint               = ""
-	defaultMaxRequestElapsedTime     = 30 * time.Second
-	defaultMaxRequests               = 1000
-	defaultNetwork                   = "tcp"
+	defaultConsolidatorFlushInterval       = 1 * time.Second
+	defaultClientTimeout                   = 10 * time.Second
+	defaultCompress                        = true
+	defaultEnableHttp2                     = false
+	defaultApiEndpoint                     = ""
+	defaultMaxRequestElapsedTime           = 30 * time.Second
+	defaultMaxRequests                     = 1000
+	defaultNetwork                         = "tcp"
+	defaultHttp2StrictMaxConcurrentStreams = true
+	defaultHttp2ReadIdleTimeout            = 30 * time.Second
+	defaultHttp2PingTimeout                = 15 * time.Second
+	defaultFormat                          = formatProtobufV2
+	defaultMinCompressSize                 = 1024
+	defaultMinRequests                     = 1
+	defaultBreakerBucketWidth              = 1 * time.Second
+	defaultBreakerNumBuckets               = 10
+	defaultBreakerFailureRatio             = 0.5
+	defaultBreakerMinSamples               = 20
+	defaultBreakerCooldown                 = 5 * time.Second
+
+	// formatProtobufV2 posts consolidated metrics as pb.RawMessageV2 to /v2/raw, the original gostatsd wire format.
+	formatProtobufV2 = "protobuf-v2"
+	// formatPrometheusRemoteWrite posts consolidated metrics as a Prometheus prompb.WriteRequest to /api/v1/write,
+	// so gostatsd can forward directly into Cortex/Mimir/Thanos/VictoriaMetrics without a separate exporter.
+	formatPrometheusRemoteWrite = "prometheus-remote-write"
 )
 
 // HttpForwarderHandlerV2 is a PipelineHandler which sends metrics to another gostatsd instance
 type HttpForwarderHandlerV2 struct {
-	postId          uint64 // atomic - used for an id in logs
-	messagesInvalid uint64 // atomic - messages which failed to be created
-	messagesCreated uint64 // atomic - messages which were created
-	messagesSent    uint64 // atomic - messages successfully sent
-	messagesRetried uint64 // atomic - retries (first send is not a retry, final failure is not a retry)
-	messagesDropped uint64 // atomic - final failure
+	postId                 uint64 // atomic - used for an id in logs
+	messagesInvalid        uint64 // atomic - messages which failed to be created
+	messagesCreated        uint64 // atomic - messages which were created
+	messagesSent           uint64 // atomic - messages successfully sent
+	messagesRetried        uint64 // atomic - retries (first send is not a retry, final failure is not a retry)
+	messagesDropped        uint64 // atomic - final failure
+	messagesShortCircuited uint64 // atomic - requests fast-failed by the open circuit breaker
+	bytesBeforeCompress    uint64 // atomic - bytes of the serialized payload, before compression
+	bytesAfterCompress     uint64 // atomic - bytes actually put on the wire, after compression
 
 	logger                logrus.FieldLogger
 	apiEndpoint           string
 	maxRequestElapsedTime time.Duration
-	metricsSem            chan struct{}
+	sem                   *adaptiveSemaphore
+	breaker               *circuitBreaker
 	client                http.Client
 	consolidator          *gostatsd.MetricConsolidator
 	consolidatedMetrics   <-chan []*gostatsd.MetricMap
 	eventWg               sync.WaitGroup
-	compress              bool
+	compressor            Compressor
+	minCompressSize       int
+	format                string
 }
 
 // NewHttpForwarderHandlerV2FromViper returns a new http API client.
@@ -69,52 +94,142 @@ func NewHttpForwarderHandlerV2FromViper(logger logrus.FieldLogger, v *viper.Vipe
 	subViper.SetDefault("consolidator-slots", v.GetInt(ParamMaxParsers))
 	subViper.SetDefault("flush-interval", defaultConsolidatorFlushInterval)
 	subViper.SetDefault("network", defaultNetwork)
+	subViper.SetDefault("http2-strict-max-concurrent-streams", defaultHttp2StrictMaxConcurrentStreams)
+	subViper.SetDefault("http2-read-idle-timeout", defaultHttp2ReadIdleTimeout)
+	subViper.SetDefault("http2-ping-timeout", defaultHttp2PingTimeout)
+	subViper.SetDefault("format", defaultFormat)
+	subViper.SetDefault("compression", "")
+	subViper.SetDefault("min-compress-size", defaultMinCompressSize)
+	subViper.SetDefault("min-requests", defaultMinRequests)
+	subViper.SetDefault("breaker-bucket-width", defaultBreakerBucketWidth)
+	subViper.SetDefault("breaker-num-buckets", defaultBreakerNumBuckets)
+	subViper.SetDefault("breaker-failure-ratio", defaultBreakerFailureRatio)
+	subViper.SetDefault("breaker-min-samples", defaultBreakerMinSamples)
+	subViper.SetDefault("breaker-cooldown", defaultBreakerCooldown)
+
+	// "compression" supersedes the older boolean "compress" flag; fall back to it for back-compat when unset.
+	compression := subViper.GetString("compression")
+	if compression == "" {
+		if subViper.GetBool("compress") {
+			compression = compressionDeflate
+		} else {
+			compression = compressionIdentity
+		}
+	}
+
+	return NewHttpForwarderHandlerV2(logger, HttpForwarderHandlerV2Config{
+		APIEndpoint:                     subViper.GetString("api-endpoint"),
+		Network:                         subViper.GetString("network"),
+		Format:                          subViper.GetString("format"),
+		Compression:                     compression,
+		ConsolidatorSlots:               subViper.GetInt("consolidator-slots"),
+		MaxRequests:                     subViper.GetInt("max-requests"),
+		MinRequests:                     subViper.GetInt("min-requests"),
+		MinCompressSize:                 subViper.GetInt("min-compress-size"),
+		EnableHttp2:                     subViper.GetBool("enable-http2"),
+		ClientTimeout:                   subViper.GetDuration("client-timeout"),
+		MaxRequestElapsedTime:           subViper.GetDuration("max-request-elapsed-time"),
+		FlushInterval:                   subViper.GetDuration("flush-interval"),
+		Http2StrictMaxConcurrentStreams: subViper.GetBool("http2-strict-max-concurrent-streams"),
+		Http2ReadIdleTimeout:            subViper.GetDuration("http2-read-idle-timeout"),
+		Http2PingTimeout:                subViper.GetDuration("http2-ping-timeout"),
+		BreakerBucketWidth:              subViper.GetDuration("breaker-bucket-width"),
+		BreakerNumBuckets:               subViper.GetInt("breaker-num-buckets"),
+		BreakerFailureRatio:             subViper.GetFloat64("breaker-failure-ratio"),
+		BreakerMinSamples:               uint64(subViper.GetInt("breaker-min-samples")),
+		BreakerCooldown:                 subViper.GetDuration("breaker-cooldown"),
+	})
+}
 
-	return NewHttpForwarderHandlerV2(
-		logger,
-		subViper.GetString("api-endpoint"),
-		subViper.GetString("network"),
-		subViper.GetInt("consolidator-slots"),
-		subViper.GetInt("max-requests"),
-		subViper.GetBool("compress"),
-		subViper.GetBool("enable-http2"),
-		subViper.GetDuration("client-timeout"),
-		subViper.GetDuration("max-request-elapsed-time"),
-		subViper.GetDuration("flush-interval"),
-	)
+// HttpForwarderHandlerV2Config holds the knobs for NewHttpForwarderHandlerV2. It exists because the handler
+// accumulated enough independent options (compression, http2 tuning, circuit breaker tuning, ...) that positional
+// arguments became error-prone to call and to extend.
+type HttpForwarderHandlerV2Config struct {
+	APIEndpoint           string
+	Network               string
+	Format                string
+	Compression           string
+	ConsolidatorSlots     int
+	MaxRequests           int
+	MinRequests           int
+	MinCompressSize       int
+	EnableHttp2           bool
+	ClientTimeout         time.Duration
+	MaxRequestElapsedTime time.Duration
+	FlushInterval         time.Duration
+
+	// Http2StrictMaxConcurrentStreams makes the http2 transport obey the server-advertised concurrent-stream
+	// limit instead of opportunistically exceeding it between SETTINGS updates; http2.Transport has no way for
+	// a client to impose its own cap (that's server-only).
+	Http2StrictMaxConcurrentStreams bool
+	Http2ReadIdleTimeout            time.Duration
+	Http2PingTimeout                time.Duration
+
+	BreakerBucketWidth  time.Duration
+	BreakerNumBuckets   int
+	BreakerFailureRatio float64
+	BreakerMinSamples   uint64
+	BreakerCooldown     time.Duration
 }
 
 // NewHttpForwarderHandlerV2 returns a new handler which dispatches metrics over http to another gostatsd server.
-func NewHttpForwarderHandlerV2(logger logrus.FieldLogger, apiEndpoint, network string, consolidatorSlots, maxRequests int, compress, enableHttp2 bool, clientTimeout, maxRequestElapsedTime time.Duration, flushInterval time.Duration) (*HttpForwarderHandlerV2, error) {
-	if apiEndpoint == "" {
+func NewHttpForwarderHandlerV2(logger logrus.FieldLogger, cfg HttpForwarderHandlerV2Config) (*HttpForwarderHandlerV2, error) {
+	if cfg.APIEndpoint == "" {
 		return nil, fmt.Errorf("api-endpoint is required")
 	}
-	if consolidatorSlots <= 0 {
+	if cfg.MinRequests <= 0 || cfg.MinRequests > cfg.MaxRequests {
+		return nil, fmt.Errorf("min-requests must be positive and no greater than max-requests")
+	}
+	switch cfg.Format {
+	case formatProtobufV2, formatPrometheusRemoteWrite:
+	default:
+		return nil, fmt.Errorf("format must be one of %q, %q", formatProtobufV2, formatPrometheusRemoteWrite)
+	}
+	if cfg.ConsolidatorSlots <= 0 {
 		return nil, fmt.Errorf("consolidator-slots must be positive")
 	}
-	if maxRequests <= 0 {
+	if cfg.MaxRequests <= 0 {
 		return nil, fmt.Errorf("max-requests must be positive")
 	}
-	if clientTimeout <= 0 {
+	if cfg.ClientTimeout <= 0 {
 		return nil, fmt.Errorf("client-timeout must be positive")
 	}
-	if maxRequestElapsedTime <= 0 {
+	if cfg.MaxRequestElapsedTime <= 0 {
 		return nil, fmt.Errorf("max-request-elapsed-time must be positive")
 	}
-	if flushInterval <= 0 {
+	if cfg.FlushInterval <= 0 {
 		return nil, fmt.Errorf("flush-interval must be positive")
 	}
+	if cfg.MinCompressSize < 0 {
+		return nil, fmt.Errorf("min-compress-size must not be negative")
+	}
+
+	compressor, err := newCompressor(cfg.Compression)
+	if err != nil {
+		return nil, err
+	}
 
 	logger.WithFields(logrus.Fields{
-		"api-endpoint":             apiEndpoint,
-		"client-timeout":           clientTimeout,
-		"compress":                 compress,
-		"enable-http2":             enableHttp2,
-		"max-request-elapsed-time": maxRequestElapsedTime,
-		"max-requests":             maxRequests,
-		"consolidator-slots":       consolidatorSlots,
-		"network":                  network,
-		"flush-interval":           flushInterval,
+		"api-endpoint":                        cfg.APIEndpoint,
+		"client-timeout":                      cfg.ClientTimeout,
+		"compression":                         cfg.Compression,
+		"min-compress-size":                   cfg.MinCompressSize,
+		"enable-http2":                        cfg.EnableHttp2,
+		"max-request-elapsed-time":            cfg.MaxRequestElapsedTime,
+		"max-requests":                        cfg.MaxRequests,
+		"consolidator-slots":                  cfg.ConsolidatorSlots,
+		"network":                             cfg.Network,
+		"format":                              cfg.Format,
+		"flush-interval":                      cfg.FlushInterval,
+		"http2-strict-max-concurrent-streams": cfg.Http2StrictMaxConcurrentStreams,
+		"http2-read-idle-timeout":             cfg.Http2ReadIdleTimeout,
+		"http2-ping-timeout":                  cfg.Http2PingTimeout,
+		"min-requests":                        cfg.MinRequests,
+		"breaker-bucket-width":                cfg.BreakerBucketWidth,
+		"breaker-num-buckets":                 cfg.BreakerNumBuckets,
+		"breaker-failure-ratio":               cfg.BreakerFailureRatio,
+		"breaker-min-samples":                 cfg.BreakerMinSamples,
+		"breaker-cooldown":                    cfg.BreakerCooldown,
 	}).Info("created HttpForwarderHandler")
 
 	dialer := &net.Dialer{
@@ -132,35 +247,44 @@ func NewHttpForwarderHandlerV2(logger logrus.FieldLogger, apiEndpoint, network s
 		},
 		DialContext: func(ctx context.Context, _, address string) (net.Conn, error) {
 			// replace the network with our own
-			return dialer.DialContext(ctx, network, address)
+			return dialer.DialContext(ctx, cfg.Network, address)
 		},
 		MaxIdleConns:    50,
 		IdleConnTimeout: 1 * time.Minute,
 	}
-	if !enableHttp2 {
+	if cfg.EnableHttp2 {
+		// ConfigureTransports enables ALPN negotiation of h2 on top of the existing
+		// *http.Transport, rather than relying on Go's implicit upgrade which only
+		// kicks in for the default dialer/TLS config.
+		h2Transport, err := http2.ConfigureTransports(transport)
+		if err != nil {
+			return nil, fmt.Errorf("failed to configure http2 transport: %v", err)
+		}
+		h2Transport.StrictMaxConcurrentStreams = cfg.Http2StrictMaxConcurrentStreams
+		h2Transport.ReadIdleTimeout = cfg.Http2ReadIdleTimeout
+		h2Transport.PingTimeout = cfg.Http2PingTimeout
+	} else {
 		// A non-nil empty map used in TLSNextProto to disable HTTP/2 support in client.
 		// https://golang.org/doc/go1.6#http2
 		transport.TLSNextProto = map[string](func(string, *tls.Conn) http.RoundTripper){}
 	}
 
-	metricsSem := make(chan struct{}, maxRequests)
-	for i := 0; i < maxRequests; i++ {
-		metricsSem <- struct{}{}
-	}
-
 	ch := make(chan []*gostatsd.MetricMap)
 
 	return &HttpForwarderHandlerV2{
 		logger:                logger.WithField("component", "http-forwarder-handler-v2"),
-		apiEndpoint:           apiEndpoint,
-		maxRequestElapsedTime: maxRequestElapsedTime,
-		metricsSem:            metricsSem,
-		compress:              compress,
-		consolidator:          gostatsd.NewMetricConsolidator(consolidatorSlots, flushInterval, ch),
+		sem:                   newAdaptiveSemaphore(cfg.MaxRequests, cfg.MinRequests, cfg.MaxRequests),
+		breaker:               newCircuitBreaker(cfg.BreakerBucketWidth, cfg.BreakerNumBuckets, cfg.BreakerFailureRatio, cfg.BreakerMinSamples, cfg.BreakerCooldown),
+		apiEndpoint:           cfg.APIEndpoint,
+		maxRequestElapsedTime: cfg.MaxRequestElapsedTime,
+		compressor:            compressor,
+		minCompressSize:       cfg.MinCompressSize,
+		format:                cfg.Format,
+		consolidator:          gostatsd.NewMetricConsolidator(cfg.ConsolidatorSlots, cfg.FlushInterval, ch),
 		consolidatedMetrics:   ch,
 		client: http.Client{
 			Transport: transport,
-			Timeout:   clientTimeout,
+			Timeout:   cfg.ClientTimeout,
 		},
 	}, nil
 }
@@ -200,12 +324,33 @@ func (hfh *HttpForwarderHandlerV2) emitMetrics(statser stats.Statser) {
 	messagesSent := atomic.SwapUint64(&hfh.messagesSent, 0)
 	messagesRetried := atomic.SwapUint64(&hfh.messagesRetried, 0)
 	messagesDropped := atomic.SwapUint64(&hfh.messagesDropped, 0)
+	messagesShortCircuited := atomic.SwapUint64(&hfh.messagesShortCircuited, 0)
+	bytesBeforeCompress := atomic.SwapUint64(&hfh.bytesBeforeCompress, 0)
+	bytesAfterCompress := atomic.SwapUint64(&hfh.bytesAfterCompress, 0)
 
 	statser.Count("http.forwarder.invalid", float64(messagesInvalid), nil)
 	statser.Count("http.forwarder.created", float64(messagesCreated), nil)
 	statser.Count("http.forwarder.sent", float64(messagesSent), nil)
 	statser.Count("http.forwarder.retried", float64(messagesRetried), nil)
 	statser.Count("http.forwarder.dropped", float64(messagesDropped), nil)
+	statser.Count("http.forwarder.shortcircuited", float64(messagesShortCircuited), nil)
+	statser.Count("http.forwarder.bytes_before_compress", float64(bytesBeforeCompress), nil)
+	statser.Count("http.forwarder.bytes_after_compress", float64(bytesAfterCompress), nil)
+	statser.Gauge("http.forwarder.concurrency_limit", float64(hfh.sem.Limit()), nil)
+	// breaker_state is 0 (closed), 1 (half-open) or 2 (open); a numeric gauge rather than three booleans since only
+	// one state is ever active at a time.
+	statser.Gauge("http.forwarder.breaker_state", breakerStateGauge(hfh.breaker.State()), nil)
+}
+
+func breakerStateGauge(s circuitBreakerState) float64 {
+	switch s {
+	case breakerHalfOpen:
+		return 1
+	case breakerOpen:
+		return 2
+	default:
+		return 0
+	}
 }
 
 func (hfh *HttpForwarderHandlerV2) Run(ctx context.Context) {
@@ -218,14 +363,19 @@ func (hfh *HttpForwarderHandlerV2) Run(ctx context.Context) {
 		case <-ctx.Done():
 			return
 		case metricMaps := <-hfh.consolidatedMetrics:
-			if !hfh.acquireSem(ctx) {
+			if !hfh.breaker.Allow() {
+				atomic.AddUint64(&hfh.messagesShortCircuited, 1)
+				continue
+			}
+			if !hfh.sem.Acquire(ctx) {
 				return
 			}
 			metricMap := mergeMaps(metricMaps)
 			postId := atomic.AddUint64(&hfh.postId, 1) - 1
 			go func(postId uint64) {
-				hfh.postMetrics(ctx, metricMap, postId)
-				hfh.releaseSem()
+				success := hfh.postMetrics(ctx, metricMap, postId)
+				hfh.breaker.Record(success)
+				hfh.sem.Release(success)
 			}(postId)
 		}
 	}
@@ -239,19 +389,6 @@ func mergeMaps(maps []*gostatsd.MetricMap) *gostatsd.MetricMap {
 	return mm
 }
 
-func (hfh *HttpForwarderHandlerV2) acquireSem(ctx context.Context) bool {
-	select {
-	case <-ctx.Done():
-		return false
-	case <-hfh.metricsSem:
-		return true
-	}
-}
-
-func (hfh *HttpForwarderHandlerV2) releaseSem() {
-	hfh.metricsSem <- struct{}{} // will never block
-}
-
 func translateToProtobufV2(metricMap *gostatsd.MetricMap) *pb.RawMessageV2 {
 	var pbMetricMap pb.RawMessageV2
 
@@ -311,12 +448,17 @@ func translateToProtobufV2(metricMap *gostatsd.MetricMap) *pb.RawMessageV2 {
 	return &pbMetricMap
 }
 
-func (hfh *HttpForwarderHandlerV2) postMetrics(ctx context.Context, metricMap *gostatsd.MetricMap, batchId uint64) {
+// postMetrics sends metricMap and reports whether it was ultimately delivered, so the caller can feed the outcome
+// into the circuit breaker and adaptive semaphore.
+func (hfh *HttpForwarderHandlerV2) postMetrics(ctx context.Context, metricMap *gostatsd.MetricMap, batchId uint64) bool {
+	if hfh.format == formatPrometheusRemoteWrite {
+		return hfh.postRemoteWrite(ctx, metricMap, batchId)
+	}
 	message := translateToProtobufV2(metricMap)
-	hfh.post(ctx, message, batchId, "metrics", "/v2/raw")
+	return hfh.post(ctx, message, batchId, "metrics", "/v2/raw")
 }
 
-func (hfh *HttpForwarderHandlerV2) post(ctx context.Context, message proto.Message, id uint64, endpointType, endpoint string) {
+func (hfh *HttpForwarderHandlerV2) post(ctx context.Context, message proto.Message, id uint64, endpointType, endpoint string) bool {
 	logger := hfh.logger.WithFields(logrus.Fields{
 		"id":   id,
 		"type": endpointType,
@@ -326,25 +468,62 @@ func (hfh *HttpForwarderHandlerV2) post(ctx context.Context, message proto.Messa
 	if err != nil {
 		atomic.AddUint64(&hfh.messagesInvalid, 1)
 		logger.WithError(err).Error("failed to create request")
-		return
-	} else {
-		atomic.AddUint64(&hfh.messagesCreated, 1)
+		return false
 	}
+	atomic.AddUint64(&hfh.messagesCreated, 1)
+
+	return hfh.sendWithRetry(ctx, logger, post)
+}
+
+// postRemoteWrite serializes metricMap as a Prometheus remote_write WriteRequest and POSTs it to /api/v1/write.
+// Unlike the protobuf-v2 format, remote_write payloads are always snappy-compressed; the compress option only
+// applies to the protobuf-v2 format.
+func (hfh *HttpForwarderHandlerV2) postRemoteWrite(ctx context.Context, metricMap *gostatsd.MetricMap, id uint64) bool {
+	logger := hfh.logger.WithFields(logrus.Fields{
+		"id":   id,
+		"type": "metrics",
+	})
 
+	raw, err := proto.Marshal(translateToRemoteWrite(ctx, metricMap))
+	if err != nil {
+		atomic.AddUint64(&hfh.messagesInvalid, 1)
+		logger.WithError(err).Error("failed to create request")
+		return false
+	}
+	atomic.AddUint64(&hfh.messagesCreated, 1)
+
+	// The remote_write protocol mandates snappy-framed protobuf regardless of the configured compression codec.
+	body := snappy.Encode(nil, raw)
+	atomic.AddUint64(&hfh.bytesBeforeCompress, uint64(len(raw)))
+	atomic.AddUint64(&hfh.bytesAfterCompress, uint64(len(body)))
+
+	post := hfh.constructPostRaw(ctx, logger, hfh.apiEndpoint+"/api/v1/write", body, map[string]string{
+		"Content-Type":                      "application/x-protobuf",
+		"Content-Encoding":                  "snappy",
+		"X-Prometheus-Remote-Write-Version": "0.1.0",
+		"User-Agent":                        "gostatsd (http forwarder)",
+	})
+
+	return hfh.sendWithRetry(ctx, logger, post)
+}
+
+// sendWithRetry drives post to completion with exponential backoff, reporting whether it ultimately succeeded.
+func (hfh *HttpForwarderHandlerV2) sendWithRetry(ctx context.Context, logger logrus.FieldLogger, post func() error) bool {
 	b := backoff.NewExponentialBackOff()
 	b.MaxElapsedTime = hfh.maxRequestElapsedTime
 
 	for {
-		if err = post(); err == nil {
+		err := post()
+		if err == nil {
 			atomic.AddUint64(&hfh.messagesSent, 1)
-			return
+			return true
 		}
 
 		next := b.NextBackOff()
 		if next == backoff.Stop {
 			atomic.AddUint64(&hfh.messagesDropped, 1)
 			logger.WithError(err).Info("failed to send, giving up")
-			return
+			return false
 		}
 
 		atomic.AddUint64(&hfh.messagesRetried, 1)
@@ -353,7 +532,7 @@ func (hfh *HttpForwarderHandlerV2) post(ctx context.Context, message proto.Messa
 		select {
 		case <-ctx.Done():
 			timer.Stop()
-			return
+			return false
 		case <-timer.C:
 		}
 	}
@@ -380,50 +559,47 @@ func (hh *HttpForwarderHandlerV2) serializeText(message proto.Message) ([]byte,
 }
 */
 
-func (hfh *HttpForwarderHandlerV2) serializeAndCompress(message proto.Message) ([]byte, error) {
-	raw, err := hfh.serialize(message)
-	if err != nil {
-		return nil, err
+// encode runs raw through the configured Compressor, unless it's smaller than minCompressSize in which case
+// compression is skipped (the framing overhead isn't worth it for tiny payloads).
+func (hfh *HttpForwarderHandlerV2) encode(raw []byte) ([]byte, string, error) {
+	if len(raw) < hfh.minCompressSize {
+		atomic.AddUint64(&hfh.bytesBeforeCompress, uint64(len(raw)))
+		atomic.AddUint64(&hfh.bytesAfterCompress, uint64(len(raw)))
+		return raw, compressionIdentity, nil
 	}
 
-	buf := &bytes.Buffer{}
-	compressor, err := zlib.NewWriterLevel(buf, zlib.BestCompression)
+	body, encoding, err := hfh.compressor.Encode(raw)
 	if err != nil {
-		return nil, err
+		return nil, "", err
 	}
-
-	_, _ = compressor.Write(raw) // error is propagated through Close
-	err = compressor.Close()
-	if err != nil {
-		return nil, err
-	}
-
-	return buf.Bytes(), nil
+	atomic.AddUint64(&hfh.bytesBeforeCompress, uint64(len(raw)))
+	atomic.AddUint64(&hfh.bytesAfterCompress, uint64(len(body)))
+	return body, encoding, nil
 }
 
 func (hfh *HttpForwarderHandlerV2) constructPost(ctx context.Context, logger logrus.FieldLogger, path string, message proto.Message) (func() error /*doPost*/, error) {
-	var body []byte
-	var err error
-	var encoding string
-
-	if hfh.compress {
-		body, err = hfh.serializeAndCompress(message)
-		encoding = "deflate"
-	} else {
-		body, err = hfh.serialize(message)
-		encoding = "identity"
+	raw, err := hfh.serialize(message)
+	if err != nil {
+		return nil, err
 	}
 
+	body, encoding, err := hfh.encode(raw)
 	if err != nil {
 		return nil, err
 	}
 
+	headers := map[string]string{
+		"Content-Type":     "application/x-protobuf",
+		"Content-Encoding": encoding,
+		"User-Agent":       "gostatsd (http forwarder)",
+	}
+	return hfh.constructPostRaw(ctx, logger, path, body, headers), nil
+}
+
+// constructPostRaw builds the doPost function shared by every wire format: it only differs in what body/headers
+// it's given, so protobuf-v2 and prometheus-remote-write both funnel through here.
+func (hfh *HttpForwarderHandlerV2) constructPostRaw(ctx context.Context, logger logrus.FieldLogger, path string, body []byte, headers map[string]string) func() error /*doPost*/ {
 	return func() error {
-		headers := map[string]string{
-			"Content-Type":     "application/x-protobuf",
-			"Content-Encoding": encoding,
-			"User-Agent":       "gostatsd (http forwarder)",
-		}
 		req, err := http.NewRequest("POST", path, bytes.NewReader(body))
 		if err != nil {
 			return fmt.Errorf("unable to create http.Request: %v", err)
@@ -449,7 +625,7 @@ func (hfh *HttpForwarderHandlerV2) constructPost(ctx context.Context, logger log
 			return fmt.Errorf("received bad status code %d", resp.StatusCode)
 		}
 		return nil
-	}, nil
+	}
 }
 
 ///////// Event processing
@@ -466,34 +642,7 @@ func (hfh *HttpForwarderHandlerV2) DispatchEvent(ctx context.Context, e *gostats
 func (hfh *HttpForwarderHandlerV2) dispatchEvent(ctx context.Context, e *gostatsd.Event) {
 	postId := atomic.AddUint64(&hfh.postId, 1) - 1
 
-	message := &pb.EventV2{
-		Title:          e.Title,
-		Text:           e.Text,
-		DateHappened:   e.DateHappened,
-		Hostname:       e.Hostname,
-		AggregationKey: e.AggregationKey,
-		SourceTypeName: e.SourceTypeName,
-		Tags:           e.Tags,
-		SourceIP:       string(e.SourceIP),
-	}
-
-	switch e.Priority {
-	case gostatsd.PriNormal:
-		message.Priority = pb.EventV2_Normal
-	case gostatsd.PriLow:
-		message.Priority = pb.EventV2_Low
-	}
-
-	switch e.AlertType {
-	case gostatsd.AlertInfo:
-		message.Type = pb.EventV2_Info
-	case gostatsd.AlertWarning:
-		message.Type = pb.EventV2_Warning
-	case gostatsd.AlertError:
-		message.Type = pb.EventV2_Error
-	case gostatsd.AlertSuccess:
-		message.Type = pb.EventV2_Success
-	}
+	message := buildEventV2(e)
 
 	hfh.post(ctx, message, postId, "event", "/v2/event")
 
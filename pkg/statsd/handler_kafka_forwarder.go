@@ -0,0 +1,390 @@
+package statsd
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+	"github.com/atlassian/gostatsd/pkg/stats"
+
+	"github.com/Shopify/sarama"
+	"github.com/ash2k/stager/wait"
+	"github.com/cenkalti/backoff"
+	"github.com/golang/protobuf/proto"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/viper"
+	"github.com/tilinna/clock"
+)
+
+const (
+	defaultKafkaConsolidatorFlushInterval = 1 * time.Second
+	defaultKafkaMetricsTopic              = "gostatsd-metrics"
+	defaultKafkaEventsTopic               = "gostatsd-events"
+	defaultKafkaMaxRequestElapsedTime     = 30 * time.Second
+	defaultKafkaRequiredAcks              = "all"
+	defaultKafkaCompression               = "snappy"
+	defaultKafkaPartitioner               = "hash"
+	defaultKafkaTLS                       = false
+	defaultKafkaMaxRequests               = 1000
+	defaultKafkaMinRequests               = 1
+)
+
+// KafkaForwarderHandler is a PipelineHandler which publishes consolidated metrics and events to Kafka as protobuf
+// records, rather than POSTing them over HTTP. It reuses the same MetricConsolidator/translateToProtobufV2 pipeline
+// as HttpForwarderHandlerV2, so it's a drop-in fan-out sink for sites that want a durable queue in front of their
+// metrics store.
+type KafkaForwarderHandler struct {
+	postId          uint64 // atomic - used for an id in logs
+	messagesInvalid uint64 // atomic - messages which failed to be created
+	messagesCreated uint64 // atomic - messages which were created
+	messagesSent    uint64 // atomic - messages successfully sent
+	messagesRetried uint64 // atomic - retries (first send is not a retry, final failure is not a retry)
+	messagesDropped uint64 // atomic - final failure
+
+	logger                logrus.FieldLogger
+	metricsTopic          string
+	eventsTopic           string
+	maxRequestElapsedTime time.Duration
+	producer              sarama.SyncProducer
+	sem                   *adaptiveSemaphore
+	consolidator          *gostatsd.MetricConsolidator
+	consolidatedMetrics   <-chan []*gostatsd.MetricMap
+	eventWg               sync.WaitGroup
+}
+
+// NewKafkaForwarderHandlerFromViper returns a new Kafka forwarder handler.
+func NewKafkaForwarderHandlerFromViper(logger logrus.FieldLogger, v *viper.Viper) (*KafkaForwarderHandler, error) {
+	subViper := getSubViper(v, "kafka-transport")
+	subViper.SetDefault("metrics-topic", defaultKafkaMetricsTopic)
+	subViper.SetDefault("events-topic", defaultKafkaEventsTopic)
+	subViper.SetDefault("required-acks", defaultKafkaRequiredAcks)
+	subViper.SetDefault("compression", defaultKafkaCompression)
+	subViper.SetDefault("partitioner", defaultKafkaPartitioner)
+	subViper.SetDefault("tls", defaultKafkaTLS)
+	subViper.SetDefault("consolidator-slots", v.GetInt(ParamMaxParsers))
+	subViper.SetDefault("flush-interval", defaultKafkaConsolidatorFlushInterval)
+	subViper.SetDefault("max-request-elapsed-time", defaultKafkaMaxRequestElapsedTime)
+	subViper.SetDefault("max-requests", defaultKafkaMaxRequests)
+	subViper.SetDefault("min-requests", defaultKafkaMinRequests)
+
+	return NewKafkaForwarderHandler(
+		logger,
+		subViper.GetStringSlice("brokers"),
+		subViper.GetString("metrics-topic"),
+		subViper.GetString("events-topic"),
+		subViper.GetString("required-acks"),
+		subViper.GetString("compression"),
+		subViper.GetString("partitioner"),
+		subViper.GetString("sasl-username"),
+		subViper.GetString("sasl-password"),
+		subViper.GetBool("tls"),
+		subViper.GetInt("consolidator-slots"),
+		subViper.GetInt("max-requests"),
+		subViper.GetInt("min-requests"),
+		subViper.GetDuration("flush-interval"),
+		subViper.GetDuration("max-request-elapsed-time"),
+	)
+}
+
+// NewKafkaForwarderHandler returns a new handler which publishes consolidated metrics and events to Kafka.
+func NewKafkaForwarderHandler(logger logrus.FieldLogger, brokers []string, metricsTopic, eventsTopic, requiredAcks, compression, partitioner, saslUsername, saslPassword string, useTLS bool, consolidatorSlots, maxRequests, minRequests int, flushInterval, maxRequestElapsedTime time.Duration) (*KafkaForwarderHandler, error) {
+	if len(brokers) == 0 {
+		return nil, fmt.Errorf("brokers is required")
+	}
+	if metricsTopic == "" {
+		return nil, fmt.Errorf("metrics-topic is required")
+	}
+	if eventsTopic == "" {
+		return nil, fmt.Errorf("events-topic is required")
+	}
+	if consolidatorSlots <= 0 {
+		return nil, fmt.Errorf("consolidator-slots must be positive")
+	}
+	if minRequests <= 0 || minRequests > maxRequests {
+		return nil, fmt.Errorf("min-requests must be positive and no greater than max-requests")
+	}
+	if flushInterval <= 0 {
+		return nil, fmt.Errorf("flush-interval must be positive")
+	}
+	if maxRequestElapsedTime <= 0 {
+		return nil, fmt.Errorf("max-request-elapsed-time must be positive")
+	}
+
+	acks, err := parseRequiredAcks(requiredAcks)
+	if err != nil {
+		return nil, err
+	}
+	codec, err := parseKafkaCompression(compression)
+	if err != nil {
+		return nil, err
+	}
+	partitionerConstructor, err := parseKafkaPartitioner(partitioner)
+	if err != nil {
+		return nil, err
+	}
+
+	logger.WithFields(logrus.Fields{
+		"brokers":                  brokers,
+		"metrics-topic":            metricsTopic,
+		"events-topic":             eventsTopic,
+		"required-acks":            requiredAcks,
+		"compression":              compression,
+		"partitioner":              partitioner,
+		"tls":                      useTLS,
+		"consolidator-slots":       consolidatorSlots,
+		"max-requests":             maxRequests,
+		"min-requests":             minRequests,
+		"flush-interval":           flushInterval,
+		"max-request-elapsed-time": maxRequestElapsedTime,
+	}).Info("created KafkaForwarderHandler")
+
+	config := sarama.NewConfig()
+	config.Producer.RequiredAcks = acks
+	config.Producer.Compression = codec
+	config.Producer.Partitioner = partitionerConstructor
+	config.Producer.Return.Successes = true // required by sarama.NewSyncProducer
+
+	if useTLS {
+		config.Net.TLS.Enable = true
+		config.Net.TLS.Config = &tls.Config{MinVersion: tls.VersionTLS12}
+	}
+	if saslUsername != "" {
+		config.Net.SASL.Enable = true
+		config.Net.SASL.User = saslUsername
+		config.Net.SASL.Password = saslPassword
+	}
+
+	producer, err := sarama.NewSyncProducer(brokers, config)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create kafka producer: %v", err)
+	}
+
+	ch := make(chan []*gostatsd.MetricMap)
+
+	return &KafkaForwarderHandler{
+		logger:                logger.WithField("component", "kafka-forwarder-handler"),
+		metricsTopic:          metricsTopic,
+		eventsTopic:           eventsTopic,
+		maxRequestElapsedTime: maxRequestElapsedTime,
+		producer:              producer,
+		sem:                   newAdaptiveSemaphore(maxRequests, minRequests, maxRequests),
+		consolidator:          gostatsd.NewMetricConsolidator(consolidatorSlots, flushInterval, ch),
+		consolidatedMetrics:   ch,
+	}, nil
+}
+
+func parseRequiredAcks(s string) (sarama.RequiredAcks, error) {
+	switch s {
+	case "none":
+		return sarama.NoResponse, nil
+	case "local":
+		return sarama.WaitForLocal, nil
+	case "all":
+		return sarama.WaitForAll, nil
+	default:
+		return 0, fmt.Errorf("required-acks must be one of none/local/all, got %q", s)
+	}
+}
+
+func parseKafkaCompression(s string) (sarama.CompressionCodec, error) {
+	switch s {
+	case "none":
+		return sarama.CompressionNone, nil
+	case "gzip":
+		return sarama.CompressionGZIP, nil
+	case "snappy":
+		return sarama.CompressionSnappy, nil
+	case "lz4":
+		return sarama.CompressionLZ4, nil
+	case "zstd":
+		return sarama.CompressionZSTD, nil
+	default:
+		return 0, fmt.Errorf("compression must be one of none/gzip/snappy/lz4/zstd, got %q", s)
+	}
+}
+
+func parseKafkaPartitioner(s string) (sarama.PartitionerConstructor, error) {
+	switch s {
+	case "hash":
+		return sarama.NewHashPartitioner, nil
+	case "random":
+		return sarama.NewRandomPartitioner, nil
+	case "round-robin":
+		return sarama.NewRoundRobinPartitioner, nil
+	default:
+		return nil, fmt.Errorf("partitioner must be one of hash/random/round-robin, got %q", s)
+	}
+}
+
+func (kfh *KafkaForwarderHandler) EstimatedTags() int {
+	return 0
+}
+
+func (kfh *KafkaForwarderHandler) DispatchMetrics(ctx context.Context, metrics []*gostatsd.Metric) {
+	kfh.consolidator.ReceiveMetrics(metrics)
+}
+
+// DispatchMetricMap hands a metric map straight to the consolidator, as DispatchMetrics does for metrics
+func (kfh *KafkaForwarderHandler) DispatchMetricMap(ctx context.Context, mm *gostatsd.MetricMap) {
+	kfh.consolidator.ReceiveMetricMap(mm)
+}
+
+func (kfh *KafkaForwarderHandler) RunMetrics(ctx context.Context) {
+	statser := stats.FromContext(ctx)
+
+	notify, cancel := statser.RegisterFlush()
+	defer cancel()
+
+	for {
+		select {
+		case <-notify:
+			kfh.emitMetrics(statser)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (kfh *KafkaForwarderHandler) emitMetrics(statser stats.Statser) {
+	messagesInvalid := atomic.SwapUint64(&kfh.messagesInvalid, 0)
+	messagesCreated := atomic.SwapUint64(&kfh.messagesCreated, 0)
+	messagesSent := atomic.SwapUint64(&kfh.messagesSent, 0)
+	messagesRetried := atomic.SwapUint64(&kfh.messagesRetried, 0)
+	messagesDropped := atomic.SwapUint64(&kfh.messagesDropped, 0)
+
+	statser.Count("kafka.forwarder.invalid", float64(messagesInvalid), nil)
+	statser.Count("kafka.forwarder.created", float64(messagesCreated), nil)
+	statser.Count("kafka.forwarder.sent", float64(messagesSent), nil)
+	statser.Count("kafka.forwarder.retried", float64(messagesRetried), nil)
+	statser.Count("kafka.forwarder.dropped", float64(messagesDropped), nil)
+	statser.Gauge("kafka.forwarder.concurrency_limit", float64(kfh.sem.Limit()), nil)
+}
+
+func (kfh *KafkaForwarderHandler) Run(ctx context.Context) {
+	var wg wait.Group
+	// producer.Close must run after every in-flight SendMessage call has returned: sarama.SyncProducer does not
+	// support a concurrent Close, so this defer order (Close deferred first, runs last) matters. wg tracks both
+	// the consolidator and every postMetrics goroutine, and eventWg tracks every event publish, so waiting on
+	// both blocks until that's actually true.
+	defer kfh.producer.Close()
+	defer kfh.eventWg.Wait()
+	defer wg.Wait()
+	wg.StartWithContext(ctx, kfh.consolidator.Run)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case metricMaps := <-kfh.consolidatedMetrics:
+			if !kfh.sem.Acquire(ctx) {
+				return
+			}
+			metricMap := mergeMaps(metricMaps)
+			postId := atomic.AddUint64(&kfh.postId, 1) - 1
+			wg.StartWithContext(ctx, func(ctx context.Context) {
+				success := kfh.postMetrics(ctx, metricMap, postId)
+				kfh.sem.Release(success)
+			})
+		}
+	}
+}
+
+func (kfh *KafkaForwarderHandler) postMetrics(ctx context.Context, metricMap *gostatsd.MetricMap, batchId uint64) bool {
+	logger := kfh.logger.WithFields(logrus.Fields{
+		"id":   batchId,
+		"type": "metrics",
+	})
+
+	message := translateToProtobufV2(metricMap)
+	body, err := proto.Marshal(message)
+	if err != nil {
+		atomic.AddUint64(&kfh.messagesInvalid, 1)
+		logger.WithError(err).Error("failed to create message")
+		return false
+	}
+	atomic.AddUint64(&kfh.messagesCreated, 1)
+
+	// Metrics are consolidated across workers and merged into a single batch (see mergeMaps), so there's no
+	// single metric name to key the record by. Leave Key unset and let the configured partitioner (default: hash,
+	// which falls back to random for an unkeyed message) spread batches across partitions. Use "round-robin" if
+	// you want a more even spread than the hash partitioner's fallback.
+	return kfh.publish(ctx, logger, &sarama.ProducerMessage{
+		Topic: kfh.metricsTopic,
+		Value: sarama.ByteEncoder(body),
+	})
+}
+
+func (kfh *KafkaForwarderHandler) publish(ctx context.Context, logger logrus.FieldLogger, message *sarama.ProducerMessage) bool {
+	b := backoff.NewExponentialBackOff()
+	b.MaxElapsedTime = kfh.maxRequestElapsedTime
+
+	for {
+		_, _, err := kfh.producer.SendMessage(message)
+		if err == nil {
+			atomic.AddUint64(&kfh.messagesSent, 1)
+			return true
+		}
+
+		next := b.NextBackOff()
+		if next == backoff.Stop {
+			atomic.AddUint64(&kfh.messagesDropped, 1)
+			logger.WithError(err).Info("failed to send, giving up")
+			return false
+		}
+
+		atomic.AddUint64(&kfh.messagesRetried, 1)
+
+		timer := clock.NewTimer(ctx, next)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+	}
+}
+
+///////// Event processing
+
+// Events are handled individually, because the context matters. If they're buffered through the consolidator, they'll
+// be processed on a goroutine with a context which will be closed during shutdown.  Events should be rare enough that
+// this isn't an issue.
+
+func (kfh *KafkaForwarderHandler) DispatchEvent(ctx context.Context, e *gostatsd.Event) {
+	kfh.eventWg.Add(1)
+	go kfh.dispatchEvent(ctx, e)
+}
+
+func (kfh *KafkaForwarderHandler) dispatchEvent(ctx context.Context, e *gostatsd.Event) {
+	defer kfh.eventWg.Done()
+
+	postId := atomic.AddUint64(&kfh.postId, 1) - 1
+	logger := kfh.logger.WithFields(logrus.Fields{
+		"id":   postId,
+		"type": "event",
+	})
+
+	message := buildEventV2(e)
+
+	body, err := proto.Marshal(message)
+	if err != nil {
+		atomic.AddUint64(&kfh.messagesInvalid, 1)
+		logger.WithError(err).Error("failed to create message")
+		return
+	}
+	atomic.AddUint64(&kfh.messagesCreated, 1)
+
+	kfh.publish(ctx, logger, &sarama.ProducerMessage{
+		Topic: kfh.eventsTopic,
+		Key:   sarama.StringEncoder(e.AggregationKey),
+		Value: sarama.ByteEncoder(body),
+	})
+}
+
+func (kfh *KafkaForwarderHandler) WaitForEvents() {
+	kfh.eventWg.Wait()
+}
@@ -0,0 +1,122 @@
+package statsd
+
+import (
+	"context"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/atlassian/gostatsd"
+
+	"github.com/prometheus/prometheus/prompb"
+	"github.com/tilinna/clock"
+)
+
+var invalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// quantiles are the percentiles timers are expanded into when translating to Prometheus remote_write. Prometheus
+// doesn't have a native timer/histogram-with-fixed-buckets type, so (similar to the statsd exporter) a timer is
+// represented as a classic summary: a _count, a _sum, and one sample per quantile.
+var quantiles = []struct {
+	quantile string
+	fraction float64
+}{
+	{"0.5", 0.5},
+	{"0.9", 0.9},
+	{"0.99", 0.99},
+}
+
+// translateToRemoteWrite converts a consolidated MetricMap into a Prometheus remote_write WriteRequest. Counters and
+// gauges become a single sample, sets become a cardinality gauge, and timers are expanded into a classic summary
+// (_count, _sum, and one sample per entry in quantiles).
+func translateToRemoteWrite(ctx context.Context, metricMap *gostatsd.MetricMap) *prompb.WriteRequest {
+	wr := &prompb.WriteRequest{}
+	timestampMs := clock.Now(ctx).UnixNano() / int64(time.Millisecond)
+
+	for metricName, m := range metricMap.Counters {
+		for _, metric := range m {
+			wr.Timeseries = append(wr.Timeseries, newTimeSeries(metricName, "", metric.Tags, metric.Hostname, metric.Value, timestampMs))
+		}
+	}
+
+	for metricName, m := range metricMap.Gauges {
+		for _, metric := range m {
+			wr.Timeseries = append(wr.Timeseries, newTimeSeries(metricName, "", metric.Tags, metric.Hostname, metric.Value, timestampMs))
+		}
+	}
+
+	for metricName, m := range metricMap.Sets {
+		for _, metric := range m {
+			wr.Timeseries = append(wr.Timeseries, newTimeSeries(metricName, "", metric.Tags, metric.Hostname, float64(len(metric.Values)), timestampMs))
+		}
+	}
+
+	for metricName, m := range metricMap.Timers {
+		for _, metric := range m {
+			wr.Timeseries = append(wr.Timeseries, newTimeSeries(metricName, "_count", metric.Tags, metric.Hostname, metric.SampledCount, timestampMs))
+
+			sum := 0.0
+			for _, v := range metric.Values {
+				sum += v
+			}
+			wr.Timeseries = append(wr.Timeseries, newTimeSeries(metricName, "_sum", metric.Tags, metric.Hostname, sum, timestampMs))
+
+			values := append([]float64(nil), metric.Values...)
+			sort.Float64s(values)
+			for _, q := range quantiles {
+				ts := newTimeSeries(metricName, "", metric.Tags, metric.Hostname, quantile(values, q.fraction), timestampMs)
+				ts.Labels = append(ts.Labels, prompb.Label{Name: "quantile", Value: q.quantile})
+				sort.Slice(ts.Labels, func(i, j int) bool { return ts.Labels[i].Name < ts.Labels[j].Name })
+				wr.Timeseries = append(wr.Timeseries, ts)
+			}
+		}
+	}
+
+	return wr
+}
+
+func quantile(sortedValues []float64, fraction float64) float64 {
+	if len(sortedValues) == 0 {
+		return 0
+	}
+	idx := int(fraction * float64(len(sortedValues)-1))
+	return sortedValues[idx]
+}
+
+func newTimeSeries(metricName, suffix string, tags gostatsd.Tags, hostname string, value float64, timestampMs int64) prompb.TimeSeries {
+	labels := make([]prompb.Label, 0, len(tags)+2)
+	labels = append(labels, prompb.Label{Name: "__name__", Value: sanitizeLabel(metricName + suffix)})
+	if hostname != "" {
+		labels = append(labels, prompb.Label{Name: "instance", Value: hostname})
+	}
+	for _, tag := range tags {
+		name, value := splitTag(tag)
+		labels = append(labels, prompb.Label{Name: sanitizeLabel(name), Value: value})
+	}
+	// The remote_write wire protocol requires each series' labels to be sorted lexicographically by name.
+	sort.Slice(labels, func(i, j int) bool { return labels[i].Name < labels[j].Name })
+
+	return prompb.TimeSeries{
+		Labels:  labels,
+		Samples: []prompb.Sample{{Value: value, Timestamp: timestampMs}},
+	}
+}
+
+// splitTag splits a gostatsd "key:value" tag into a label name/value pair. Tags with no ':' are treated as boolean
+// tags and get a value of "true", matching how gostatsd renders them elsewhere.
+func splitTag(tag string) (string, string) {
+	if idx := strings.IndexByte(tag, ':'); idx >= 0 {
+		return tag[:idx], tag[idx+1:]
+	}
+	return tag, "true"
+}
+
+// sanitizeLabel rewrites s into a valid Prometheus label/metric name: [a-zA-Z_][a-zA-Z0-9_]*
+func sanitizeLabel(s string) string {
+	s = invalidLabelChars.ReplaceAllString(s, "_")
+	if s == "" || (s[0] >= '0' && s[0] <= '9') {
+		s = "_" + s
+	}
+	return s
+}